@@ -16,17 +16,22 @@ package cups
 
 const char
     *POST_RESOURCE        = "/",
+    *POST_METHOD          = "POST",
     *REQUESTED_ATTRIBUTES = "requested-attributes",
 		*JOB_URI_ATTRIBUTE    = "job-uri",
 		*IPP                  = "ipp";
 */
 import "C"
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"runtime"
+	"sync/atomic"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/golang/glog"
@@ -38,29 +43,58 @@ const (
 	jobURIFormat = "/jobs/%d"
 )
 
-// cupsCore protects the CUPS C.http_t connection with a mutex. Although
+// cupsCoreCGO keeps a bounded pool of CUPS C.http_t connections. Although
 // the CUPS API claims that it is thread-safe, this library panics under
-// very little pressure without the mutex.
-type cupsCore struct {
-	host       *C.char
-	port       C.int
-	encryption C.http_encryption_t
+// very little pressure without some form of serialization, so connect()
+// and disconnect() hand connections out of (and back into) a buffered
+// channel guarded by a counting semaphore.
+type cupsCoreCGO struct {
+	host           *C.char
+	port           C.int
+	encryption     C.http_encryption_t
+	connectTimeout C.int // milliseconds, as expected by httpConnect2.
+	authType       cupsAuthType
+
+	connectionPool      chan *C.http_t
+	connectionSemaphore *semaphore
 }
 
-func newCUPSCore() (*cupsCore, error) {
+// newCGOCUPSCore creates a cupsCoreCGO whose connection pool holds at
+// most maxConnections connections at once, and whose dial attempts time
+// out after connectTimeout. authType selects how doRequest responds to
+// an HTTP_STATUS_UNAUTHORIZED response.
+func newCGOCUPSCore(maxConnections uint, connectTimeout time.Duration, authType cupsAuthType) (*cupsCoreCGO, error) {
 	host := C.cupsServer()
 	port := C.ippPort()
 	encryption := C.cupsEncryption()
 
-	cc := &cupsCore{host, port, encryption}
+	// No client-side setup call is needed for CUPSAuthTypeNegotiate:
+	// cupsSetServerCredentials() configures the TLS credential store this
+	// process presents when acting as an HTTPS server, which doesn't apply
+	// here. GSSAPI/Kerberos negotiation itself is handled entirely inside
+	// cupsDoAuthentication() (see doRequest) when libcups was built
+	// --with-gssapi and the process has a valid ticket cache (KRB5CCNAME);
+	// there's no public libcups API to toggle that on or off per-core.
+
+	cc := &cupsCoreCGO{
+		host:                host,
+		port:                port,
+		encryption:          encryption,
+		connectTimeout:      C.int(connectTimeout / time.Millisecond),
+		authType:            authType,
+		connectionPool:      make(chan *C.http_t, maxConnections),
+		connectionSemaphore: newSemaphore(maxConnections),
+	}
 
 	// This connection isn't used, just checks that a connection is possible
-	// before returning from the constructor.
-	http, err := cc.connect()
+	// before returning from the constructor. There's no caller context at
+	// construction time, so it waits (and dials) unbounded by anything but
+	// connectTimeout.
+	http, err := cc.connect(context.Background())
 	if err != nil {
 		return nil, err
 	}
-	C.httpClose(http)
+	cc.disconnect(http)
 
 	var e string
 	switch encryption {
@@ -85,62 +119,199 @@ func newCUPSCore() (*cupsCore, error) {
 // printFile prints by calling C.cupsPrintFile2().
 // Returns the CUPS job ID, which is 0 (and meaningless) when err
 // is not nil.
-func (cc *cupsCore) printFile(user, printername, filename, title *C.char, numOptions C.int, options *C.cups_option_t) (C.int, error) {
+func (cc *cupsCoreCGO) printFile(ctx context.Context, user, printerName, filename, title string, options map[string]string) (uint32, error) {
+	cUser := C.CString(user)
+	defer C.free(unsafe.Pointer(cUser))
+	cPrinterName := C.CString(printerName)
+	defer C.free(unsafe.Pointer(cPrinterName))
+	cFilename := C.CString(filename)
+	defer C.free(unsafe.Pointer(cFilename))
+	cTitle := C.CString(title)
+	defer C.free(unsafe.Pointer(cTitle))
+
+	var cOptions *C.cups_option_t
+	numOptions := C.int(0)
+	for k, v := range options {
+		cKey := C.CString(k)
+		cValue := C.CString(v)
+		numOptions = C.cupsAddOption(cKey, cValue, numOptions, &cOptions)
+		C.free(unsafe.Pointer(cKey))
+		C.free(unsafe.Pointer(cValue))
+	}
+	defer C.cupsFreeOptions(numOptions, cOptions)
+
 	// Lock the OS thread so that thread-local storage is available to
 	// cupsLastError() and cupsLastErrorString().
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
-	http, err := cc.connect()
+	http, err := cc.connect(ctx)
 	if err != nil {
 		return 0, err
 	}
-	defer C.httpClose(http)
+	if deadline, ok := ctx.Deadline(); ok {
+		C.httpSetTimeout(http, C.double(time.Until(deadline).Seconds()), nil, nil)
+	}
+	stop := watchContext(ctx, http)
+	var aborted bool
+	defer func() { cc.disposeConnection(http, aborted) }()
 
-	C.cupsSetUser(user)
-	jobID := C.cupsPrintFile2(http, printername, filename, title, numOptions, options)
+	C.cupsSetUser(cUser)
+	jobID := C.cupsPrintFile2(http, cPrinterName, cFilename, cTitle, numOptions, cOptions)
+	ctxFired := stop()
 	if jobID == 0 {
+		// Whether or not ctx fired, a failed cupsPrintFile2 leaves the
+		// connection's protocol state indeterminate, so it must not go
+		// back into the pool for the next caller to inherit.
+		aborted = true
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
 		return 0, fmt.Errorf("Failed to call cupsPrintFile2(): %d %s",
 			int(C.cupsLastError()), C.GoString(C.cupsLastErrorString()))
 	}
 
-	return jobID, nil
+	aborted = ctxFired
+	return uint32(jobID), nil
+}
+
+// printStream prints document by calling C.cupsCreateJob, then
+// C.cupsStartDocument/C.cupsWriteRequestData/C.cupsFinishDocument, so the
+// payload is streamed straight from document instead of requiring a
+// filename on disk the way printFile does.
+func (cc *cupsCoreCGO) printStream(ctx context.Context, user, printerName, title, format string, options map[string]string, document io.Reader) (uint32, error) {
+	cUser := C.CString(user)
+	defer C.free(unsafe.Pointer(cUser))
+	cPrinterName := C.CString(printerName)
+	defer C.free(unsafe.Pointer(cPrinterName))
+	cTitle := C.CString(title)
+	defer C.free(unsafe.Pointer(cTitle))
+	cFormat := C.CString(format)
+	defer C.free(unsafe.Pointer(cFormat))
+
+	var cOptions *C.cups_option_t
+	numOptions := C.int(0)
+	for k, v := range options {
+		cKey := C.CString(k)
+		cValue := C.CString(v)
+		numOptions = C.cupsAddOption(cKey, cValue, numOptions, &cOptions)
+		C.free(unsafe.Pointer(cKey))
+		C.free(unsafe.Pointer(cValue))
+	}
+	defer C.cupsFreeOptions(numOptions, cOptions)
+
+	// Lock the OS thread so that thread-local storage is available to
+	// cupsLastError() and cupsLastErrorString().
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	http, err := cc.connect(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		C.httpSetTimeout(http, C.double(time.Until(deadline).Seconds()), nil, nil)
+	}
+	stop := watchContext(ctx, http)
+	var aborted bool
+	defer func() { cc.disposeConnection(http, aborted) }()
+
+	// Every failure branch below marks aborted unconditionally (not just
+	// when ctx fired): each leaves the connection's cupsCreateJob/
+	// cupsStartDocument/cupsWriteRequestData/cupsFinishDocument protocol
+	// exchange incomplete, so the connection must be closed rather than
+	// pooled regardless of why the step failed.
+	C.cupsSetUser(cUser)
+	jobID := C.cupsCreateJob(http, cPrinterName, cTitle, numOptions, cOptions)
+	if jobID == 0 {
+		aborted = true
+		stop()
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("Failed to call cupsCreateJob(): %d %s",
+			int(C.cupsLastError()), C.GoString(C.cupsLastErrorString()))
+	}
+
+	if status := C.cupsStartDocument(http, cPrinterName, jobID, nil, cFormat, C.int(1)); status != C.HTTP_STATUS_CONTINUE {
+		aborted = true
+		stop()
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("Failed to call cupsStartDocument(): HTTP status %d", int(status))
+	}
+
+	buf := make([]byte, 65536)
+	for {
+		n, rerr := document.Read(buf)
+		if n > 0 {
+			if status := C.cupsWriteRequestData(http, (*C.char)(unsafe.Pointer(&buf[0])), C.size_t(n)); status != C.HTTP_STATUS_CONTINUE {
+				aborted = true
+				stop()
+				if err := ctx.Err(); err != nil {
+					return 0, err
+				}
+				return 0, fmt.Errorf("Failed to call cupsWriteRequestData(): HTTP status %d", int(status))
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			aborted = true
+			stop()
+			return 0, fmt.Errorf("Failed to read document data: %s", rerr)
+		}
+	}
+
+	if status := C.cupsFinishDocument(http, cPrinterName); status != C.IPP_STATUS_OK {
+		aborted = true
+		stop()
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("Failed to call cupsFinishDocument(): IPP status %d", int(status))
+	}
+
+	aborted = stop()
+	return uint32(jobID), nil
 }
 
 // getPrinters gets the current list and state of printers by calling
-// C.doRequest (IPP_OP_CUPS_GET_PRINTERS).
-//
-// The caller is responsible to C.ippDelete the returned *C.ipp_t response.
-func (cc *cupsCore) getPrinters(attributes **C.char, attrSize C.int) (*C.ipp_t, error) {
+// cc.doRequest (IPP_OP_CUPS_GET_PRINTERS), returning one printerAttributes
+// per printer.
+func (cc *cupsCoreCGO) getPrinters(ctx context.Context, attributes []string) ([]printerAttributes, error) {
+	cAttributes, freeAttributes := goStringsToC(attributes)
+	defer freeAttributes()
+
 	// ippNewRequest() returns ipp_t pointer which does not need explicit free.
 	request := C.ippNewRequest(C.IPP_OP_CUPS_GET_PRINTERS)
 	C.ippAddStrings(request, C.IPP_TAG_OPERATION, C.IPP_TAG_KEYWORD, C.REQUESTED_ATTRIBUTES,
-		attrSize, nil, attributes)
+		C.int(len(attributes)), nil, cAttributes)
 
-	response, err := cc.doRequestWithRetry(request,
+	response, err := cc.doRequestWithRetry(ctx, request,
 		[]C.ipp_status_t{C.IPP_STATUS_OK, C.IPP_STATUS_ERROR_NOT_FOUND})
 	if err != nil {
-		err = fmt.Errorf("Failed to call cupsDoRequest() [IPP_OP_CUPS_GET_PRINTERS]: %s", err)
-		return nil, err
+		return nil, fmt.Errorf("Failed to call cupsDoRequest() [IPP_OP_CUPS_GET_PRINTERS]: %s", err)
 	}
+	defer C.ippDelete(response)
 
-	return response, nil
+	return ippResponseToGroups(response, C.IPP_TAG_PRINTER), nil
 }
 
 // getPPD gets the filename of the PPD for a printer by calling
-// C.cupsGetPPD3. If the PPD hasn't changed since the time indicated
-// by modtime, then the returned filename is a nil pointer.
-//
-// Note that modtime is a pointer whose value is changed by this
-// function.
-//
-// The caller is responsible to C.free the returned *C.char filename
-// if the returned filename is not nil.
-func (cc *cupsCore) getPPD(printername *C.char, modtime *C.time_t) (*C.char, error) {
+// C.cupsGetPPD3. If the PPD hasn't changed since modtime, the returned
+// filename is empty.
+func (cc *cupsCoreCGO) getPPD(ctx context.Context, printerName string, modtime time.Time) (string, time.Time, error) {
+	cPrinterName := C.CString(printerName)
+	defer C.free(unsafe.Pointer(cPrinterName))
+	cModtime := C.time_t(modtime.Unix())
+
 	bufsize := C.size_t(syscall.PathMax)
 	buffer := (*C.char)(C.malloc(bufsize))
 	if buffer == nil {
-		return nil, errors.New("Failed to malloc; out of memory?")
+		return "", time.Time{}, errors.New("Failed to malloc; out of memory?")
 	}
 	C.memset(unsafe.Pointer(buffer), 0, bufsize)
 
@@ -149,67 +320,112 @@ func (cc *cupsCore) getPPD(printername *C.char, modtime *C.time_t) (*C.char, err
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
-	http, err := cc.connect()
+	http, err := cc.connect(ctx)
 	if err != nil {
-		return nil, err
+		C.free(unsafe.Pointer(buffer))
+		return "", time.Time{}, err
 	}
-	defer C.httpClose(http)
+	if deadline, ok := ctx.Deadline(); ok {
+		C.httpSetTimeout(http, C.double(time.Until(deadline).Seconds()), nil, nil)
+	}
+	stop := watchContext(ctx, http)
+	var aborted bool
+	defer func() { cc.disposeConnection(http, aborted) }()
 
-	httpStatus := C.cupsGetPPD3(http, printername, modtime, buffer, bufsize)
+	httpStatus := C.cupsGetPPD3(http, cPrinterName, &cModtime, buffer, bufsize)
+	ctxFired := stop()
 
 	switch httpStatus {
 	case C.HTTP_STATUS_NOT_MODIFIED:
 		// Cache hit.
+		aborted = ctxFired
 		if len(C.GoString(buffer)) > 0 {
 			os.Remove(C.GoString(buffer))
 		}
 		C.free(unsafe.Pointer(buffer))
-		return nil, nil
+		return "", time.Unix(int64(cModtime), 0), nil
 
 	case C.HTTP_STATUS_OK:
 		// Cache miss.
-		return buffer, nil
+		aborted = ctxFired
+		filename := C.GoString(buffer)
+		C.free(unsafe.Pointer(buffer))
+		return filename, time.Unix(int64(cModtime), 0), nil
 
 	default:
+		// Whether or not ctx fired, a failed cupsGetPPD3 leaves the
+		// connection's protocol state indeterminate, so it must not go
+		// back into the pool for the next caller to inherit.
+		aborted = true
 		if len(C.GoString(buffer)) > 0 {
 			os.Remove(C.GoString(buffer))
 		}
 		C.free(unsafe.Pointer(buffer))
+		if err := ctx.Err(); err != nil {
+			return "", time.Time{}, err
+		}
 		cupsLastError := C.cupsLastError()
 		if cupsLastError != C.IPP_STATUS_OK {
-			return nil, fmt.Errorf("Failed to call cupsGetPPD3(): %d %s",
+			return "", time.Time{}, fmt.Errorf("Failed to call cupsGetPPD3(): %d %s",
 				int(cupsLastError), C.GoString(C.cupsLastErrorString()))
 		}
 
-		return nil, fmt.Errorf("Failed to call cupsGetPPD3(); HTTP status: %d", int(httpStatus))
+		return "", time.Time{}, fmt.Errorf("Failed to call cupsGetPPD3(); HTTP status: %d", int(httpStatus))
 	}
 }
 
 // getJobAttributes gets the requested attributes for a job by calling
 // C.doRequest (IPP_OP_GET_JOB_ATTRIBUTES).
-//
-// The caller is responsible to C.ippDelete the returned *C.ipp_t response.
-func (cc *cupsCore) getJobAttributes(jobID C.int, attributes **C.char) (*C.ipp_t, error) {
-	uri, err := createJobURI(jobID)
+func (cc *cupsCoreCGO) getJobAttributes(ctx context.Context, jobID uint32, attributes []string) (printerAttributes, error) {
+	uri, err := createJobURI(C.int(jobID))
 	if err != nil {
 		return nil, err
 	}
 	defer C.free(unsafe.Pointer(uri))
 
+	cAttributes, freeAttributes := goStringsToC(attributes)
+	defer freeAttributes()
+
 	// ippNewRequest() returns ipp_t pointer does not need explicit free.
 	request := C.ippNewRequest(C.IPP_OP_GET_JOB_ATTRIBUTES)
 
 	C.ippAddString(request, C.IPP_TAG_OPERATION, C.IPP_TAG_URI, C.JOB_URI_ATTRIBUTE, nil, uri)
 	C.ippAddStrings(request, C.IPP_TAG_OPERATION, C.IPP_TAG_KEYWORD, C.REQUESTED_ATTRIBUTES,
-		C.int(0), nil, attributes)
+		C.int(len(attributes)), nil, cAttributes)
 
-	response, err := cc.doRequestWithRetry(request, []C.ipp_status_t{C.IPP_STATUS_OK})
+	response, err := cc.doRequestWithRetry(ctx, request, []C.ipp_status_t{C.IPP_STATUS_OK})
 	if err != nil {
-		err = fmt.Errorf("Failed to call cupsDoRequest() [IPP_OP_GET_JOB_ATTRIBUTES]: %s", err)
-		return nil, err
+		return nil, fmt.Errorf("Failed to call cupsDoRequest() [IPP_OP_GET_JOB_ATTRIBUTES]: %s", err)
+	}
+	defer C.ippDelete(response)
+
+	groups := ippResponseToGroups(response, C.IPP_TAG_JOB)
+	if len(groups) == 0 {
+		return printerAttributes{}, nil
 	}
 
-	return response, nil
+	return groups[0], nil
+}
+
+// cancelJob cancels a job by calling cc.doRequest (IPP_OP_CANCEL_JOB).
+func (cc *cupsCoreCGO) cancelJob(ctx context.Context, jobID uint32) error {
+	uri, err := createJobURI(C.int(jobID))
+	if err != nil {
+		return err
+	}
+	defer C.free(unsafe.Pointer(uri))
+
+	// ippNewRequest() returns ipp_t pointer does not need explicit free.
+	request := C.ippNewRequest(C.IPP_OP_CANCEL_JOB)
+	C.ippAddString(request, C.IPP_TAG_OPERATION, C.IPP_TAG_URI, C.JOB_URI_ATTRIBUTE, nil, uri)
+
+	response, err := cc.doRequestWithRetry(ctx, request, []C.ipp_status_t{C.IPP_STATUS_OK})
+	if err != nil {
+		return fmt.Errorf("Failed to call cupsDoRequest() [IPP_OP_CANCEL_JOB]: %s", err)
+	}
+	defer C.ippDelete(response)
+
+	return nil
 }
 
 // createJobURI creates a uri string for the job-uri attribute, used to get the
@@ -229,33 +445,176 @@ func createJobURI(jobID C.int) (*C.char, error) {
 	return uri, nil
 }
 
-// doRequestWithRetry calls doRequest and retries once on failure.
-func (cc *cupsCore) doRequestWithRetry(request *C.ipp_t, acceptableStatusCodes []C.ipp_status_t) (*C.ipp_t, error) {
-	response, err := cc.doRequest(request, acceptableStatusCodes)
-	if err == nil {
+// goStringsToC converts strs to a C char** suitable for passing to
+// C.ippAddStrings. The returned free function must be called once the
+// caller is done with the array.
+func goStringsToC(strs []string) (**C.char, func()) {
+	if len(strs) == 0 {
+		return nil, func() {}
+	}
+
+	cStrs := make([]*C.char, len(strs))
+	for i, s := range strs {
+		cStrs[i] = C.CString(s)
+	}
+
+	return &cStrs[0], func() {
+		for _, s := range cStrs {
+			C.free(unsafe.Pointer(s))
+		}
+	}
+}
+
+// ippResponseToGroups splits the attributes of response into one
+// printerAttributes per group whose group tag is groupTag (IPP_TAG_JOB
+// or IPP_TAG_PRINTER), discarding the operation-attributes and
+// unsupported-attributes groups.
+func ippResponseToGroups(response *C.ipp_t, groupTag C.ipp_tag_t) []printerAttributes {
+	var groups []printerAttributes
+	var current printerAttributes
+	lastGroup := C.ipp_tag_t(0)
+
+	for attr := C.ippFirstAttribute(response); attr != nil; attr = C.ippNextAttribute(response) {
+		group := C.ippGetGroupTag(attr)
+		if group != lastGroup {
+			if group == groupTag {
+				current = printerAttributes{}
+				groups = append(groups, current)
+			} else {
+				current = nil
+			}
+			lastGroup = group
+		}
+
+		if current == nil {
+			continue
+		}
+		name := C.GoString(C.ippGetName(attr))
+		if name == "" {
+			continue
+		}
+		current[name] = ippAttributeStrings(attr)
+	}
+
+	return groups
+}
+
+// ippAttributeStrings reads every value of attr and stringifies it,
+// using the binary getters for integer/boolean/rangeOfInteger syntaxes
+// and C.ippGetString for everything else (keyword, enum-as-string, uri,
+// text, name, etc.).
+func ippAttributeStrings(attr *C.ipp_attribute_t) []string {
+	count := int(C.ippGetCount(attr))
+	values := make([]string, count)
+	valueTag := C.ippGetValueTag(attr)
+
+	for i := 0; i < count; i++ {
+		switch valueTag {
+		case C.IPP_TAG_INTEGER, C.IPP_TAG_ENUM:
+			values[i] = fmt.Sprintf("%d", int(C.ippGetInteger(attr, C.int(i))))
+		case C.IPP_TAG_BOOLEAN:
+			values[i] = fmt.Sprintf("%t", C.ippGetBoolean(attr, C.int(i)) != 0)
+		case C.IPP_TAG_RANGE:
+			var upper C.int
+			lower := C.ippGetRange(attr, C.int(i), &upper)
+			values[i] = fmt.Sprintf("%d-%d", int(lower), int(upper))
+		default:
+			values[i] = C.GoString(C.ippGetString(attr, C.int(i), nil))
+		}
+	}
+
+	return values
+}
+
+// doRequestWithRetry calls doRequest and retries once on failure, unless
+// ctx is already done (a retry wouldn't do anything but wait out the rest
+// of a timeout that already fired). It frees request with C.ippDelete
+// once done, since cupsSendRequest (unlike cupsDoRequest) does not.
+func (cc *cupsCoreCGO) doRequestWithRetry(ctx context.Context, request *C.ipp_t, acceptableStatusCodes []C.ipp_status_t) (*C.ipp_t, error) {
+	defer C.ippDelete(request)
+
+	response, err := cc.doRequest(ctx, request, acceptableStatusCodes)
+	if err == nil || ctx.Err() != nil {
 		return response, err
 	}
 
-	return cc.doRequest(request, acceptableStatusCodes)
+	return cc.doRequest(ctx, request, acceptableStatusCodes)
 }
 
-// doRequest calls cupsDoRequest().
-func (cc *cupsCore) doRequest(request *C.ipp_t, acceptableStatusCodes []C.ipp_status_t) (*C.ipp_t, error) {
+// doRequest sends request with cupsSendRequest()/cupsGetResponse(),
+// rather than the simpler cupsDoRequest(), so that an
+// HTTP_STATUS_UNAUTHORIZED response can be answered with
+// cupsDoAuthentication() and retried. Without this, a cupsd configured
+// with AuthType Negotiate (GSSAPI/Kerberos) fails every request, since
+// cupsDoRequest has no hook to drive authentication mid-request. ctx
+// bounds the whole round trip, including the authentication retry.
+func (cc *cupsCoreCGO) doRequest(ctx context.Context, request *C.ipp_t, acceptableStatusCodes []C.ipp_status_t) (*C.ipp_t, error) {
 	// Lock the OS thread so that thread-local storage is available to
 	// cupsLastError() and cupsLastErrorString().
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
-	http, err := cc.connect()
+	http, err := cc.connect(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer C.httpClose(http)
+	if deadline, ok := ctx.Deadline(); ok {
+		C.httpSetTimeout(http, C.double(time.Until(deadline).Seconds()), nil, nil)
+	}
+	stop := watchContext(ctx, http)
+	var aborted bool
+	defer func() { cc.disposeConnection(http, aborted) }()
+
+	// Every failure branch below marks aborted unconditionally (not just
+	// when ctx fired): each leaves the send/response exchange incomplete,
+	// so the connection must be closed rather than pooled regardless of
+	// why the step failed. Only reaching a fully-read response, even one
+	// with an unacceptable IPP status code, leaves the connection in a
+	// state doRequestWithRetry or the next caller can safely reuse.
+	length := C.ippLength(request)
+	httpStatus := C.cupsSendRequest(http, request, C.POST_RESOURCE, length)
+
+	if httpStatus == C.HTTP_STATUS_UNAUTHORIZED && cc.authType != CUPSAuthTypeNone && cc.authType != "" {
+		if C.cupsDoAuthentication(http, C.POST_METHOD, C.POST_RESOURCE) != 0 {
+			aborted = true
+			stop()
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("cupsDoAuthentication failed: %d %s",
+				int(C.cupsLastError()), C.GoString(C.cupsLastErrorString()))
+		}
+		if C.httpReconnect2(http, cc.connectTimeout, nil) != 0 {
+			aborted = true
+			stop()
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("Failed to reconnect after authentication: %d %s",
+				int(C.cupsLastError()), C.GoString(C.cupsLastErrorString()))
+		}
+		httpStatus = C.cupsSendRequest(http, request, C.POST_RESOURCE, length)
+	}
+
+	if httpStatus != C.HTTP_STATUS_CONTINUE && httpStatus != C.HTTP_STATUS_OK {
+		aborted = true
+		stop()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("cupsSendRequest failed: HTTP status %d", int(httpStatus))
+	}
 
-	response := C.cupsDoRequest(http, request, C.POST_RESOURCE)
+	response := C.cupsGetResponse(http, C.POST_RESOURCE)
 	if response == nil {
-		return nil, fmt.Errorf("cupsDoRequest failed: %d %s", int(C.cupsLastError()), C.GoString(C.cupsLastErrorString()))
+		aborted = true
+		stop()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("cupsGetResponse failed: %d %s", int(C.cupsLastError()), C.GoString(C.cupsLastErrorString()))
 	}
+	aborted = stop()
 	statusCode := C.ippGetStatusCode(response)
 	for _, sc := range acceptableStatusCodes {
 		if statusCode == sc {
@@ -266,18 +625,105 @@ func (cc *cupsCore) doRequest(request *C.ipp_t, acceptableStatusCodes []C.ipp_st
 	return nil, fmt.Errorf("IPP status code %d", int(statusCode))
 }
 
-// connect calls C.httpConnectEncrypt to create a new, open
-// connection to the CUPS server specified by environment variables,
-// client.conf, etc.
+// connect acquires a slot on the connection semaphore, then returns an
+// idle connection from the pool if one is available, or dials a new one
+// with C.httpConnect2 otherwise. ctx bounds both steps: waiting on a full
+// pool can otherwise block indefinitely (pinning the caller's locked OS
+// thread the whole time), and the dial itself is capped at whichever of
+// ctx's remaining deadline and the configured connectTimeout is shorter.
 //
-// The caller is responsible to close the connection when finished
-// using C.httpClose.
-func (cc *cupsCore) connect() (*C.http_t, error) {
-	http := C.httpConnectEncrypt(cc.host, cc.port, cc.encryption)
+// The caller is responsible to pass the connection to disconnect() when
+// finished with it, so that it can be reused or closed.
+func (cc *cupsCoreCGO) connect(ctx context.Context) (*C.http_t, error) {
+	if err := cc.connectionSemaphore.acquire(ctx); err != nil {
+		return nil, err
+	}
+
+	select {
+	case http := <-cc.connectionPool:
+		return http, nil
+	default:
+	}
+
+	dialTimeout := cc.connectTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := C.int(time.Until(deadline) / time.Millisecond); remaining < dialTimeout {
+			dialTimeout = remaining
+		}
+	}
+
+	http := C.httpConnect2(cc.host, cc.port, nil, C.AF_UNSPEC, cc.encryption,
+		1, dialTimeout, nil)
 	if http == nil {
+		cc.connectionSemaphore.release()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		return nil, fmt.Errorf("Failed to connect to CUPS server %s:%d because %d %s",
 			C.GoString(cc.host), int(cc.port), int(C.cupsLastError()), C.GoString(C.cupsLastErrorString()))
 	}
 
 	return http, nil
-}
\ No newline at end of file
+}
+
+// disconnect returns http to the connection pool for reuse, or closes it
+// if the pool is already full (or http is nil), and releases the slot
+// that connect() acquired on the connection semaphore.
+func (cc *cupsCoreCGO) disconnect(http *C.http_t) {
+	defer cc.connectionSemaphore.release()
+
+	if http == nil {
+		return
+	}
+
+	select {
+	case cc.connectionPool <- http:
+	default:
+		C.httpClose(http)
+	}
+}
+
+// watchContext starts a goroutine that calls C.httpShutdown(http) as
+// soon as ctx is done, so a cgo call blocked inside libcups (which has
+// no way to pass a context.Context down to) unblocks promptly instead of
+// pinning its locked OS thread until cupsd responds or the process
+// dies. The caller must call the returned stop function exactly once, as
+// soon as the blocking call returns; stop waits for the watcher goroutine
+// to exit, and its result reports whether ctx fired first, so the caller
+// knows not to pool a connection cupsd may now consider dead.
+func watchContext(ctx context.Context, http *C.http_t) (stop func() (aborted bool)) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	var fired int32
+
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			atomic.StoreInt32(&fired, 1)
+			C.httpShutdown(http)
+		case <-done:
+		}
+	}()
+
+	return func() bool {
+		close(done)
+		<-exited
+		return atomic.LoadInt32(&fired) == 1
+	}
+}
+
+// disposeConnection returns http to the pool via disconnect(), unless
+// aborted is set (watchContext fired, or the caller's exchange with cupsd
+// failed part-way), in which case http is assumed unusable and is closed
+// outright.
+func (cc *cupsCoreCGO) disposeConnection(http *C.http_t, aborted bool) {
+	if aborted {
+		C.httpClose(http)
+		cc.connectionSemaphore.release()
+		return
+	}
+	cc.disconnect(http)
+}
+
+var _ cupsCore = (*cupsCoreCGO)(nil)
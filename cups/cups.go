@@ -0,0 +1,114 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package cups
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// printerAttributes is one group of IPP attributes (one printer, or one
+// job) keyed by attribute name. Values are always represented as
+// strings: keyword/enum/uri/text values are native strings already, and
+// integer/boolean/rangeOfInteger values are stringified by the backend
+// that decoded them, so callers don't need to know which backend is in
+// use.
+type printerAttributes map[string][]string
+
+// cupsCore is the transport used to talk to a CUPS server. cupsCoreCGO
+// implements it by calling into libcups via cgo; cupsCoreNative
+// implements it as a pure Go IPP/1.1 client. See newCUPSCore.
+//
+// Every method takes a context.Context so a caller can bound how long it
+// waits on a slow or hung CUPS server; ctx.Done() aborts the in-flight
+// call rather than leaving it to time out (or never return) on its own.
+type cupsCore interface {
+	// printFile prints filename; cupsCoreCGO does so by calling
+	// C.cupsPrintFile2(), while cupsCoreNative does not support it and
+	// always returns an error. It returns the CUPS job ID, which is 0 (and
+	// meaningless) when err is not nil.
+	printFile(ctx context.Context, user, printerName, filename, title string, options map[string]string) (jobID uint32, err error)
+
+	// printStream prints the contents of document by streaming a
+	// Create-Job followed by a single Send-Document call, so the
+	// caller never has to materialize the print payload on disk. format
+	// is the document's IPP document-format (MIME type), e.g.
+	// "application/pdf". It returns the CUPS job ID, which is 0 (and
+	// meaningless) when err is not nil.
+	printStream(ctx context.Context, user, printerName, title, format string, options map[string]string, document io.Reader) (jobID uint32, err error)
+
+	// getPrinters gets the current list and state of printers, returning
+	// one printerAttributes per printer.
+	getPrinters(ctx context.Context, attributes []string) ([]printerAttributes, error)
+
+	// getPPD gets the filename of a printer's PPD. If the PPD hasn't
+	// changed since modtime, the returned filename is empty.
+	getPPD(ctx context.Context, printerName string, modtime time.Time) (filename string, newModtime time.Time, err error)
+
+	// getJobAttributes gets the requested attributes for a job.
+	getJobAttributes(ctx context.Context, jobID uint32, attributes []string) (printerAttributes, error)
+
+	// cancelJob cancels a job by id.
+	cancelJob(ctx context.Context, jobID uint32) error
+}
+
+// cupsBackend selects which cupsCore implementation newCUPSCore builds.
+type cupsBackend string
+
+const (
+	// CUPSBackendCGO calls into libcups via cgo. This is the default, and
+	// the only backend that supports GSSAPI/Kerberos authentication.
+	CUPSBackendCGO cupsBackend = "cgo"
+
+	// CUPSBackendNative speaks IPP/1.1 directly over plain HTTP to
+	// nativeDefaultServerURI with no libcups dependency, for hosts where
+	// libcups isn't installed. It does not use TLS.
+	CUPSBackendNative cupsBackend = "native"
+)
+
+// cupsAuthType selects how cupsCoreCGO answers an
+// HTTP_STATUS_UNAUTHORIZED response, corresponding to cupsd's AuthType
+// directive. This maps to the connector's CUPSAuthType config field.
+type cupsAuthType string
+
+const (
+	// CUPSAuthTypeNone leaves HTTP_STATUS_UNAUTHORIZED as a terminal
+	// error; this is the default.
+	CUPSAuthTypeNone cupsAuthType = "none"
+
+	// CUPSAuthTypeBasic relies on libcups' own Basic/Digest password
+	// callback, which cupsDoAuthentication() invokes.
+	CUPSAuthTypeBasic cupsAuthType = "basic"
+
+	// CUPSAuthTypeNegotiate drives GSSAPI/Kerberos negotiation via
+	// cupsDoAuthentication() against a cupsd configured with AuthType
+	// Negotiate. Only supported by CUPSBackendCGO.
+	CUPSAuthTypeNegotiate cupsAuthType = "negotiate"
+)
+
+// newCUPSCore builds the cupsCore implementation named by backend,
+// connecting to the local CUPS server with a pool of at most
+// maxConnections connections and a connect timeout of connectTimeout. An
+// empty backend selects CUPSBackendCGO. authType is only meaningful for
+// CUPSBackendCGO; CUPSBackendNative rejects anything but
+// CUPSAuthTypeNone.
+func newCUPSCore(backend cupsBackend, maxConnections uint, connectTimeout time.Duration, authType cupsAuthType) (cupsCore, error) {
+	switch backend {
+	case "", CUPSBackendCGO:
+		return newCGOCUPSCore(maxConnections, connectTimeout, authType)
+	case CUPSBackendNative:
+		if authType != "" && authType != CUPSAuthTypeNone {
+			return nil, fmt.Errorf("CUPS auth type %q requires CUPS backend %q", authType, CUPSBackendCGO)
+		}
+		return newNativeCUPSCore(maxConnections, connectTimeout)
+	default:
+		return nil, fmt.Errorf("unknown CUPS backend %q; want %q or %q", backend, CUPSBackendCGO, CUPSBackendNative)
+	}
+}
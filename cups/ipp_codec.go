@@ -0,0 +1,235 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package cups
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ippAttribute is one operation attribute to encode into an IPP request,
+// e.g. requested-attributes or job-uri.
+type ippAttribute struct {
+	name   string
+	tag    ippValueTag
+	values []string
+}
+
+// encodeIPPRequest builds the bytes of an IPP/1.1 request with operation
+// version 1.1, the given operation id and request id, and attrs encoded
+// into the operation-attributes group. The caller appends any document
+// data (for Send-Document/Print-Job) after this buffer.
+func encodeIPPRequest(op ippOp, requestID int32, attrs []ippAttribute) []byte {
+	buf := new(bufferedWriter)
+
+	buf.writeByte(1) // version-major
+	buf.writeByte(1) // version-minor
+	buf.writeUint16(uint16(op))
+	buf.writeUint32(uint32(requestID))
+
+	buf.writeByte(byte(ippTagOperation))
+	writeIPPAttribute(buf, "attributes-charset", ippTagCharset, []string{"utf-8"})
+	writeIPPAttribute(buf, "attributes-natural-language", ippTagNaturalLanguage, []string{"en"})
+	for _, a := range attrs {
+		writeIPPAttribute(buf, a.name, a.tag, a.values)
+	}
+
+	buf.writeByte(byte(ippTagEnd))
+
+	return buf.Bytes()
+}
+
+// writeIPPAttribute writes one (possibly multi-valued) attribute. Per RFC
+// 8011 section 4.1.4, only the first value of a multi-valued attribute
+// carries the name; later values repeat the tag with a zero-length name.
+func writeIPPAttribute(buf *bufferedWriter, name string, tag ippValueTag, values []string) {
+	for i, v := range values {
+		buf.writeByte(byte(tag))
+		n := name
+		if i > 0 {
+			n = ""
+		}
+		buf.writeUint16(uint16(len(n)))
+		buf.writeString(n)
+		buf.writeUint16(uint16(len(v)))
+		buf.writeString(v)
+	}
+}
+
+// booleanIPPValue encodes b as the one-byte value a boolean-tagged IPP
+// attribute carries on the wire (RFC 8011 section 3.5.2), for use as an
+// ippAttribute value, e.g. for last-document.
+func booleanIPPValue(b bool) string {
+	if b {
+		return string([]byte{1})
+	}
+	return string([]byte{0})
+}
+
+// decodeIPPResponse parses an IPP/1.1 response, returning its status code
+// and its job- and printer-attributes groups. Operation- and
+// unsupported-attributes groups are skipped. Collection values (RFC 8011
+// section 3.1.6, e.g. media-col-default) are not decoded into nested
+// structures; their memberAttrName/value pairs are discarded by
+// skipCollection so they never leak into the enclosing group as bogus
+// top-level attribute names.
+func decodeIPPResponse(body io.Reader) (ippStatusCode, []printerAttributes, error) {
+	r := bufio.NewReader(body)
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, fmt.Errorf("short IPP response header: %s", err)
+	}
+	statusCode := ippStatusCode(binary.BigEndian.Uint16(header[2:4]))
+
+	var groups []printerAttributes
+	var current printerAttributes
+	lastName := ""
+
+	for {
+		tag, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, fmt.Errorf("truncated IPP response: %s", err)
+		}
+
+		if tag < 0x10 {
+			switch ippGroupTag(tag) {
+			case ippTagEnd:
+				return statusCode, groups, nil
+			case ippTagPrinter, ippTagJob:
+				current = printerAttributes{}
+				groups = append(groups, current)
+			default:
+				current = nil
+			}
+			lastName = ""
+			continue
+		}
+
+		name, value, err := readIPPAttribute(r, ippValueTag(tag))
+		if err != nil {
+			return 0, nil, err
+		}
+		if ippValueTag(tag) == ippTagBegCollection {
+			if err := skipCollection(r); err != nil {
+				return 0, nil, err
+			}
+			lastName = name
+			continue
+		}
+		if name == "" {
+			name = lastName
+		} else {
+			lastName = name
+		}
+		if current != nil && name != "" {
+			current[name] = append(current[name], value)
+		}
+	}
+}
+
+// skipCollection discards the memberAttrName/value pairs of a collection
+// value, up through its matching ippTagEndCollection, including any
+// collections nested inside it. This package doesn't decode collection
+// structure, so the alternative would be letting member attributes leak
+// into the enclosing group as bogus top-level attribute names.
+func skipCollection(r *bufio.Reader) error {
+	for depth := 1; depth > 0; {
+		tag, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("truncated IPP collection: %s", err)
+		}
+		if tag < 0x10 {
+			return fmt.Errorf("unexpected group tag 0x%02x inside IPP collection", tag)
+		}
+
+		if _, _, err := readIPPAttribute(r, ippValueTag(tag)); err != nil {
+			return err
+		}
+
+		switch ippValueTag(tag) {
+		case ippTagBegCollection:
+			depth++
+		case ippTagEndCollection:
+			depth--
+		}
+	}
+	return nil
+}
+
+// readIPPAttribute reads one name/value pair and stringifies the value
+// according to tag. Integer-like syntaxes (integer, enum,
+// rangeOfInteger, boolean) are decoded from their binary encoding;
+// keyword/enum-as-keyword/uri/charset/naturalLanguage/text/name values
+// are already UTF-8 text on the wire and are passed through unchanged.
+func readIPPAttribute(r *bufio.Reader, tag ippValueTag) (name, value string, err error) {
+	nameLen, err := readUint16(r)
+	if err != nil {
+		return "", "", err
+	}
+	nameBytes := make([]byte, nameLen)
+	if _, err := io.ReadFull(r, nameBytes); err != nil {
+		return "", "", err
+	}
+
+	valueLen, err := readUint16(r)
+	if err != nil {
+		return "", "", err
+	}
+	valueBytes := make([]byte, valueLen)
+	if _, err := io.ReadFull(r, valueBytes); err != nil {
+		return "", "", err
+	}
+
+	switch tag {
+	case ippTagInteger, ippTagEnum:
+		if len(valueBytes) == 4 {
+			return string(nameBytes), fmt.Sprintf("%d", int32(binary.BigEndian.Uint32(valueBytes))), nil
+		}
+	case ippTagBoolean:
+		if len(valueBytes) == 1 {
+			return string(nameBytes), fmt.Sprintf("%t", valueBytes[0] != 0), nil
+		}
+	case ippTagRange:
+		if len(valueBytes) == 8 {
+			lower := int32(binary.BigEndian.Uint32(valueBytes[0:4]))
+			upper := int32(binary.BigEndian.Uint32(valueBytes[4:8]))
+			return string(nameBytes), fmt.Sprintf("%d-%d", lower, upper), nil
+		}
+	}
+
+	return string(nameBytes), string(valueBytes), nil
+}
+
+func readUint16(r *bufio.Reader) (int, error) {
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(b)), nil
+}
+
+// bufferedWriter is a tiny byte-buffer writer used instead of
+// bytes.Buffer plus encoding/binary.Write calls, to keep
+// encodeIPPRequest free of per-field error checking (bytes.Buffer writes
+// never fail).
+type bufferedWriter struct {
+	b []byte
+}
+
+func (w *bufferedWriter) writeByte(b byte)        { w.b = append(w.b, b) }
+func (w *bufferedWriter) writeString(s string)    { w.b = append(w.b, s...) }
+func (w *bufferedWriter) writeUint16(v uint16) {
+	w.b = append(w.b, byte(v>>8), byte(v))
+}
+func (w *bufferedWriter) writeUint32(v uint32) {
+	w.b = append(w.b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+func (w *bufferedWriter) Bytes() []byte { return w.b }
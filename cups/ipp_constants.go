@@ -0,0 +1,69 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package cups
+
+// ippOp is an IPP operation id, as sent in the operation-id field of an
+// IPP request (RFC 8011 section 5.2), including the CUPS extension ops
+// this package uses.
+type ippOp uint16
+
+const (
+	ippOpGetJobAttributes ippOp = 0x0009
+	ippOpCreateJob        ippOp = 0x0005
+	ippOpSendDocument     ippOp = 0x0006
+	ippOpCancelJob        ippOp = 0x0008
+	ippOpCUPSGetPrinters  ippOp = 0x4002
+)
+
+// ippGroupTag delimits a group of attributes within an IPP request or
+// response (RFC 8011 section 4.1.4). Group tags are always < 0x10, which
+// is how a decoder tells them apart from value tags on the wire.
+type ippGroupTag byte
+
+const (
+	ippTagOperation        ippGroupTag = 0x01
+	ippTagJob              ippGroupTag = 0x02
+	ippTagEnd              ippGroupTag = 0x03
+	ippTagPrinter          ippGroupTag = 0x04
+	ippTagUnsupportedGroup ippGroupTag = 0x05
+)
+
+// ippValueTag identifies the syntax of a single IPP attribute value (RFC
+// 8011 section 4.1.5 and the IANA IPP registry). Only the syntaxes this
+// package encodes or decodes are named here; other syntaxes are passed
+// through as raw strings, and collection members are discarded (see
+// skipCollection).
+type ippValueTag byte
+
+const (
+	ippTagNoValue         ippValueTag = 0x13
+	ippTagInteger         ippValueTag = 0x21
+	ippTagBoolean         ippValueTag = 0x22
+	ippTagEnum            ippValueTag = 0x23
+	ippTagString          ippValueTag = 0x30
+	ippTagDateTime        ippValueTag = 0x31
+	ippTagResolution      ippValueTag = 0x32
+	ippTagRange           ippValueTag = 0x33
+	ippTagBegCollection   ippValueTag = 0x34
+	ippTagEndCollection   ippValueTag = 0x37
+	ippTagTextWithoutLang ippValueTag = 0x41
+	ippTagNameWithoutLang ippValueTag = 0x42
+	ippTagKeyword         ippValueTag = 0x44
+	ippTagURI             ippValueTag = 0x45
+	ippTagCharset         ippValueTag = 0x47
+	ippTagNaturalLanguage ippValueTag = 0x48
+	ippTagMimeMediaType   ippValueTag = 0x49
+)
+
+// ippStatusCode is an IPP response status-code (RFC 8011 section 13).
+type ippStatusCode uint16
+
+const (
+	ippStatusOK            ippStatusCode = 0x0000
+	ippStatusErrorNotFound ippStatusCode = 0x0406
+)
@@ -0,0 +1,189 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package cups
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// jobStateReason is a bitfield translation of the IPP job-state-reasons
+// keyword list (RFC 8011 section 4.3.8 and the IANA IPP registry). Only
+// the reasons that matter for surfacing accounting and held-for-release
+// conditions are named; any keyword not in jobStateReasonKeywords is
+// dropped rather than failing the poll.
+type jobStateReason uint32
+
+const (
+	jobStateReasonAccountAuthorizationFailed jobStateReason = 1 << iota
+	jobStateReasonAccountClosed
+	jobStateReasonAccountInfoNeeded
+	jobStateReasonAccountLimitReached
+	jobStateReasonJobPasswordWait
+	jobStateReasonJobReleaseWait
+	jobStateReasonDocumentFormatError
+	jobStateReasonDocumentUnprintable
+)
+
+// jobStateReasonKeywords maps the job-state-reasons keywords this
+// package understands to their bit.
+var jobStateReasonKeywords = map[string]jobStateReason{
+	"account-authorization-failed": jobStateReasonAccountAuthorizationFailed,
+	"account-closed":               jobStateReasonAccountClosed,
+	"account-info-needed":          jobStateReasonAccountInfoNeeded,
+	"account-limit-reached":        jobStateReasonAccountLimitReached,
+	"job-password-wait":            jobStateReasonJobPasswordWait,
+	"job-release-wait":             jobStateReasonJobReleaseWait,
+	"document-format-error":        jobStateReasonDocumentFormatError,
+	"document-unprintable":         jobStateReasonDocumentUnprintable,
+}
+
+// parseJobStateReasons turns a job-state-reasons keyword list into a
+// bitfield, ignoring keywords (e.g. "none", "job-completed-successfully")
+// that this package doesn't surface as a bit.
+func parseJobStateReasons(keywords []string) jobStateReason {
+	var reasons jobStateReason
+	for _, k := range keywords {
+		reasons |= jobStateReasonKeywords[k]
+	}
+	return reasons
+}
+
+// jobMonitorAttributes are the job-attributes monitorJob requests on
+// every poll.
+var jobMonitorAttributes = []string{
+	"job-state",
+	"job-state-reasons",
+	"job-impressions-completed",
+	"job-media-sheets-completed",
+}
+
+// Terminal job-state values (RFC 8011 section 4.3.7); once reached, the
+// job won't change state again and monitorJob stops polling.
+const (
+	ippJobStateCanceled  = 7
+	ippJobStateAborted   = 8
+	ippJobStateCompleted = 9
+)
+
+// jobStateTransition is one observed change in a job's state, decoded
+// from a Get-Job-Attributes poll.
+type jobStateTransition struct {
+	JobState             int
+	JobStateReasons      jobStateReason
+	ImpressionsCompleted int
+	MediaSheetsCompleted int
+}
+
+// isTerminal reports whether this transition's job-state is one the job
+// cannot leave.
+func (t jobStateTransition) isTerminal() bool {
+	switch t.JobState {
+	case ippJobStateCanceled, ippJobStateAborted, ippJobStateCompleted:
+		return true
+	default:
+		return false
+	}
+}
+
+// monitorJob polls cc for jobID's state with adaptive backoff, starting
+// at minPollInterval and doubling (capped at maxPollInterval) each time a
+// poll observes no change, resetting to minPollInterval whenever
+// something changes. It sends one jobStateTransition per observed
+// change (the first successful poll always counts as a change), closes
+// the returned channel once the job reaches a terminal state or the
+// stop function is called. The channel's buffer of 1 lets the poller get
+// one transition ahead of a slow receiver, but a second transition before
+// the first is drained does block the poller (until the receiver catches
+// up or the stop function is called); callers that need every transition
+// without stalling the poll loop should drain the channel promptly. Each
+// poll is issued with ctx, so a deadline on ctx bounds every individual
+// getJobAttributes call the same way it would for a one-off caller.
+//
+// This exists so callers don't have to re-issue getJobAttributes and
+// re-parse the job-state-reasons keyword array themselves.
+func monitorJob(ctx context.Context, cc cupsCore, jobID uint32, minPollInterval, maxPollInterval time.Duration) (<-chan jobStateTransition, func()) {
+	transitions := make(chan jobStateTransition, 1)
+	ctx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		defer close(transitions)
+
+		interval := minPollInterval
+		var last jobStateTransition
+		haveLast := false
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+
+			attrs, err := cc.getJobAttributes(ctx, jobID, jobMonitorAttributes)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				// Transient poll failures back off like a no-change poll;
+				// the next successful poll still reports whatever changed
+				// across the gap.
+				interval = backoff(interval, maxPollInterval)
+				continue
+			}
+
+			current := jobStateTransition{
+				JobState:             firstInt(attrs["job-state"]),
+				JobStateReasons:      parseJobStateReasons(attrs["job-state-reasons"]),
+				ImpressionsCompleted: firstInt(attrs["job-impressions-completed"]),
+				MediaSheetsCompleted: firstInt(attrs["job-media-sheets-completed"]),
+			}
+
+			if haveLast && current == last {
+				interval = backoff(interval, maxPollInterval)
+				continue
+			}
+
+			haveLast = true
+			last = current
+			interval = minPollInterval
+
+			select {
+			case transitions <- current:
+			case <-ctx.Done():
+				return
+			}
+
+			if current.isTerminal() {
+				return
+			}
+		}
+	}()
+
+	return transitions, cancel
+}
+
+func backoff(interval, max time.Duration) time.Duration {
+	interval *= 2
+	if interval > max {
+		interval = max
+	}
+	return interval
+}
+
+// firstInt parses the first value of an IPP integer-syntax attribute
+// (already stringified by the cupsCore backend), returning 0 if values
+// is empty or unparseable.
+func firstInt(values []string) int {
+	if len(values) == 0 {
+		return 0
+	}
+	n, _ := strconv.Atoi(values[0])
+	return n
+}
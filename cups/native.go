@@ -0,0 +1,287 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package cups
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// nativeDefaultServerURI matches the default CUPS install, the same
+// default that C.cupsServer()/C.ippPort() resolve to when no
+// CUPS_SERVER/client.conf override is present.
+const nativeDefaultServerURI = "http://localhost:631"
+
+// cupsCoreNative is a pure Go cupsCore implementation that speaks IPP/1.1
+// directly over plain HTTP to nativeDefaultServerURI, without libcups; it
+// does not use TLS. It lets the connector run on
+// hosts where libcups isn't installed, and lets getPrinters/
+// getJobAttributes run truly concurrently: there's no cgo thread-local
+// cupsLastError()/cupsLastErrorString() state to serialize around, so
+// callers don't need runtime.LockOSThread() or the mutex-like connection
+// pool that cupsCoreCGO uses to stay safe.
+type cupsCoreNative struct {
+	client    *http.Client
+	serverURI *url.URL
+	requestID int32 // atomic; see nextRequestID.
+}
+
+// newNativeCUPSCore creates a cupsCoreNative that pools up to
+// maxConnections idle HTTP connections (via net/http's own transport
+// pooling) and dials new ones with connectTimeout.
+func newNativeCUPSCore(maxConnections uint, connectTimeout time.Duration) (*cupsCoreNative, error) {
+	serverURI, err := url.Parse(nativeDefaultServerURI)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CUPS server URI: %s", err)
+	}
+
+	transport := &http.Transport{
+		MaxIdleConnsPerHost: int(maxConnections),
+		DialContext:         (&net.Dialer{Timeout: connectTimeout}).DialContext,
+	}
+
+	return &cupsCoreNative{
+		client:    &http.Client{Transport: transport},
+		serverURI: serverURI,
+	}, nil
+}
+
+func (cc *cupsCoreNative) nextRequestID() int32 {
+	return atomic.AddInt32(&cc.requestID, 1)
+}
+
+// doRequest POSTs an IPP request built from op and attrs to the CUPS
+// server and decodes the response, returning an error unless the
+// response status code is one of acceptable.
+func (cc *cupsCoreNative) doRequest(ctx context.Context, op ippOp, attrs []ippAttribute, acceptable []ippStatusCode) ([]printerAttributes, error) {
+	return cc.doRequestWithBody(ctx, op, attrs, nil, acceptable)
+}
+
+// doRequestWithBody is doRequest plus a document-data payload streamed
+// after the attributes, for Send-Document. document may be nil. ctx
+// bounds the whole HTTP round trip: net/http aborts the request as soon
+// as ctx is done, so there's no separate timeout/cancellation plumbing
+// to wire up the way cupsCoreCGO needs for its blocking cgo calls.
+func (cc *cupsCoreNative) doRequestWithBody(ctx context.Context, op ippOp, attrs []ippAttribute, document io.Reader, acceptable []ippStatusCode) ([]printerAttributes, error) {
+	header := encodeIPPRequest(op, cc.nextRequestID(), attrs)
+
+	var body io.Reader = bytes.NewReader(header)
+	if document != nil {
+		body = io.MultiReader(body, document)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cc.serverURI.String()+"/", body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/ipp")
+
+	resp, err := cc.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("IPP request 0x%04x failed: %s", uint16(op), err)
+	}
+	defer resp.Body.Close()
+
+	statusCode, groups, err := decodeIPPResponse(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode IPP response: %s", err)
+	}
+
+	for _, sc := range acceptable {
+		if statusCode == sc {
+			return groups, nil
+		}
+	}
+
+	return nil, fmt.Errorf("IPP status code 0x%04x", uint16(statusCode))
+}
+
+// getPrinters gets the current list and state of printers via
+// IPP_OP_CUPS_GET_PRINTERS.
+func (cc *cupsCoreNative) getPrinters(ctx context.Context, attributes []string) ([]printerAttributes, error) {
+	attrs := []ippAttribute{
+		{name: "requested-attributes", tag: ippTagKeyword, values: attributes},
+	}
+
+	groups, err := cc.doRequest(ctx, ippOpCUPSGetPrinters, attrs,
+		[]ippStatusCode{ippStatusOK, ippStatusErrorNotFound})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to call Get-Printers: %s", err)
+	}
+
+	return groups, nil
+}
+
+// getJobAttributes gets the requested attributes for a job via
+// IPP_OP_GET_JOB_ATTRIBUTES.
+func (cc *cupsCoreNative) getJobAttributes(ctx context.Context, jobID uint32, attributes []string) (printerAttributes, error) {
+	jobURI := fmt.Sprintf("%s%s", cc.serverURI.String(), fmt.Sprintf(jobURIFormat, jobID))
+	attrs := []ippAttribute{
+		{name: "job-uri", tag: ippTagURI, values: []string{jobURI}},
+		{name: "requested-attributes", tag: ippTagKeyword, values: attributes},
+	}
+
+	groups, err := cc.doRequest(ctx, ippOpGetJobAttributes, attrs, []ippStatusCode{ippStatusOK})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to call Get-Job-Attributes: %s", err)
+	}
+	if len(groups) == 0 {
+		return printerAttributes{}, nil
+	}
+
+	return groups[0], nil
+}
+
+// cancelJob cancels a job via IPP_OP_CANCEL_JOB.
+func (cc *cupsCoreNative) cancelJob(ctx context.Context, jobID uint32) error {
+	jobURI := fmt.Sprintf("%s%s", cc.serverURI.String(), fmt.Sprintf(jobURIFormat, jobID))
+	attrs := []ippAttribute{
+		{name: "job-uri", tag: ippTagURI, values: []string{jobURI}},
+	}
+
+	if _, err := cc.doRequest(ctx, ippOpCancelJob, attrs, []ippStatusCode{ippStatusOK}); err != nil {
+		return fmt.Errorf("Failed to call Cancel-Job: %s", err)
+	}
+
+	return nil
+}
+
+// getPPD fetches a printer's PPD over HTTP, the same way CUPS clients do
+// (CUPS serves PPDs at /printers/<name>.ppd rather than via an IPP op).
+// If the PPD hasn't changed since modtime, the returned filename is
+// empty.
+func (cc *cupsCoreNative) getPPD(ctx context.Context, printerName string, modtime time.Time) (string, time.Time, error) {
+	ppdURL := fmt.Sprintf("%s/printers/%s.ppd", cc.serverURI.String(), url.PathEscape(printerName))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ppdURL, nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if !modtime.IsZero() {
+		req.Header.Set("If-Modified-Since", modtime.UTC().Format(http.TimeFormat))
+	}
+
+	resp, err := cc.client.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("Failed to fetch PPD for %s: %s", printerName, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return "", modtime, nil
+
+	case http.StatusOK:
+		newModtime := modtime
+		if lm := resp.Header.Get("Last-Modified"); lm != "" {
+			if t, err := http.ParseTime(lm); err == nil {
+				newModtime = t
+			}
+		}
+
+		f, err := ioutil.TempFile("", "ppd")
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		defer f.Close()
+		if _, err := io.Copy(f, resp.Body); err != nil {
+			return "", time.Time{}, err
+		}
+
+		return f.Name(), newModtime, nil
+
+	default:
+		return "", time.Time{}, fmt.Errorf("Failed to fetch PPD for %s; HTTP status %d", printerName, resp.StatusCode)
+	}
+}
+
+// printFile is not implemented on the native backend: Create-Job plus
+// streamed Send-Document (printStream, below) replaces the file-based
+// spooling model entirely rather than reimplementing it.
+func (cc *cupsCoreNative) printFile(ctx context.Context, user, printerName, filename, title string, options map[string]string) (uint32, error) {
+	return 0, errors.New("native CUPS backend does not support printFile; use printStream")
+}
+
+// printStream prints document by issuing Create-Job followed by a
+// single Send-Document request whose body streams document straight
+// through to the HTTP request (net/http chunks the transfer-encoding
+// itself), with last-document=true. Per RFC 8011 section 3.3.1,
+// Send-Document adds one complete document to the job and last-document
+// says there are no more documents to follow — it is not a marker for
+// the end of this document's bytes, so document must never be split
+// across multiple Send-Document calls.
+func (cc *cupsCoreNative) printStream(ctx context.Context, user, printerName, title, format string, options map[string]string, document io.Reader) (uint32, error) {
+	printerURI := fmt.Sprintf("%s/printers/%s", cc.serverURI.String(), url.PathEscape(printerName))
+
+	createAttrs := []ippAttribute{
+		{name: "printer-uri", tag: ippTagURI, values: []string{printerURI}},
+		{name: "requesting-user-name", tag: ippTagNameWithoutLang, values: []string{user}},
+		{name: "job-name", tag: ippTagNameWithoutLang, values: []string{title}},
+	}
+	for k, v := range options {
+		createAttrs = append(createAttrs, ippAttribute{name: k, tag: ippTagKeyword, values: []string{v}})
+	}
+
+	groups, err := cc.doRequest(ctx, ippOpCreateJob, createAttrs, []ippStatusCode{ippStatusOK})
+	if err != nil {
+		return 0, fmt.Errorf("Failed to call Create-Job: %s", err)
+	}
+	jobID, jobURI, err := jobIDAndURI(groups)
+	if err != nil {
+		return 0, err
+	}
+
+	sendAttrs := []ippAttribute{
+		{name: "job-uri", tag: ippTagURI, values: []string{jobURI}},
+		{name: "requesting-user-name", tag: ippTagNameWithoutLang, values: []string{user}},
+		{name: "document-format", tag: ippTagMimeMediaType, values: []string{format}},
+		{name: "last-document", tag: ippTagBoolean, values: []string{booleanIPPValue(true)}},
+	}
+
+	if _, err := cc.doRequestWithBody(ctx, ippOpSendDocument, sendAttrs, document, []ippStatusCode{ippStatusOK}); err != nil {
+		return 0, fmt.Errorf("Failed to call Send-Document: %s", err)
+	}
+
+	return jobID, nil
+}
+
+// jobIDAndURI extracts job-id and job-uri from a Create-Job response's
+// job-attributes group.
+func jobIDAndURI(groups []printerAttributes) (uint32, string, error) {
+	if len(groups) == 0 {
+		return 0, "", errors.New("Create-Job response had no job-attributes group")
+	}
+	job := groups[0]
+
+	idStrs := job["job-id"]
+	if len(idStrs) == 0 {
+		return 0, "", errors.New("Create-Job response is missing job-id")
+	}
+	id, err := strconv.ParseUint(idStrs[0], 10, 32)
+	if err != nil {
+		return 0, "", fmt.Errorf("Failed to parse job-id %q: %s", idStrs[0], err)
+	}
+
+	uriStrs := job["job-uri"]
+	if len(uriStrs) == 0 {
+		return 0, "", errors.New("Create-Job response is missing job-uri")
+	}
+
+	return uint32(id), uriStrs[0], nil
+}
+
+var _ cupsCore = (*cupsCoreNative)(nil)
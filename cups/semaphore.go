@@ -0,0 +1,37 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package cups
+
+import "context"
+
+// semaphore is a simple counting semaphore built on a buffered channel,
+// used to bound the number of concurrent CUPS connections.
+type semaphore chan struct{}
+
+// newSemaphore creates a semaphore with n slots available.
+func newSemaphore(n uint) *semaphore {
+	s := make(semaphore, n)
+	return &s
+}
+
+// acquire blocks until a slot is available or ctx is done, whichever
+// comes first, so a caller waiting on a full pool doesn't pin its
+// (likely locked) OS thread past its own deadline.
+func (s *semaphore) acquire(ctx context.Context) error {
+	select {
+	case *s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees a slot that was previously acquired.
+func (s *semaphore) release() {
+	<-*s
+}